@@ -0,0 +1,204 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// createArchive streams a zip or tar.gz of the requested completed
+// downloads straight to the client, named <category>/<filename> inside the
+// archive so the on-disk category layout is preserved.
+func createArchive(c *gin.Context) {
+	var req struct {
+		IDs    []string `json:"ids"`
+		Format string   `json:"format"`
+		Name   string   `json:"name"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	if req.Format != "zip" && req.Format != "tar.gz" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be \"zip\" or \"tar.gz\""})
+		return
+	}
+	if req.Name == "" {
+		req.Name = "goload-archive"
+	}
+
+	downloadsMu.Lock()
+	var selected []*Download
+	for _, id := range req.IDs {
+		dl, exists := downloads[id]
+		if !exists || dl.Status != "completed" {
+			continue
+		}
+		if _, err := os.Stat(dl.Filepath); err != nil {
+			continue
+		}
+		selected = append(selected, dl)
+	}
+	downloadsMu.Unlock()
+
+	if len(selected) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No matching completed downloads found"})
+		return
+	}
+
+	if req.Format == "zip" {
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, req.Name))
+		c.Header("Content-Type", "application/zip")
+		writeZipArchive(c.Writer, selected)
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.tar.gz"`, req.Name))
+	c.Header("Content-Type", "application/gzip")
+	writeTarGzArchive(c.Writer, selected)
+}
+
+func writeZipArchive(w io.Writer, downloads []*Download) {
+	zw := zip.NewWriter(w)
+	defer zw.Close()
+
+	for _, dl := range downloads {
+		entry, err := zw.Create(archiveEntryName(dl))
+		if err != nil {
+			continue
+		}
+		copyFileInto(entry, dl.Filepath)
+	}
+}
+
+func writeTarGzArchive(w io.Writer, downloads []*Download) {
+	gzw := gzip.NewWriter(w)
+	defer gzw.Close()
+	tw := tar.NewWriter(gzw)
+	defer tw.Close()
+
+	for _, dl := range downloads {
+		headerWritten, err := writeTarEntry(tw, dl)
+		if err == nil {
+			continue
+		}
+		if !headerWritten {
+			// Nothing was committed to the stream for this entry (it
+			// never got past opening/stat'ing the file), so it's safe to
+			// just skip it, same as the old os.Stat+continue behavior.
+			log.Println("Skipping tar entry, file unavailable:", dl.Filepath, err)
+			continue
+		}
+		// WriteHeader already committed this entry to a byte count;
+		// once that promise can't be kept, every entry after it in the
+		// stream is desynced, so stop instead of continuing.
+		log.Println("Error writing tar entry, aborting archive:", dl.Filepath, err)
+		return
+	}
+}
+
+// writeTarEntry opens dl.Filepath itself, rather than trusting the
+// earlier os.Stat done while selecting completed downloads, and only
+// calls WriteHeader once the file is confirmed readable. headerWritten
+// reports whether WriteHeader was called, so the caller knows whether a
+// failure can be skipped or must abort the whole stream: WriteHeader
+// commits the tar stream to info.Size() bytes for this entry, so writing
+// fewer bytes than that afterward would corrupt the stream.
+func writeTarEntry(tw *tar.Writer, dl *Download) (headerWritten bool, err error) {
+	f, err := os.Open(dl.Filepath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return false, err
+	}
+	header.Name = archiveEntryName(dl)
+	if err := tw.WriteHeader(header); err != nil {
+		return true, err
+	}
+	_, err = io.Copy(tw, f)
+	return true, err
+}
+
+func archiveEntryName(dl *Download) string {
+	category := filepath.Base(filepath.Dir(dl.Filepath))
+	return filepath.Join(category, dl.Filename)
+}
+
+func copyFileInto(w io.Writer, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	io.Copy(w, f)
+}
+
+// getFile serves a single completed download by ID for direct retrieval.
+func getFile(c *gin.Context) {
+	id := c.Param("id")
+
+	downloadsMu.Lock()
+	dl, exists := downloads[id]
+	downloadsMu.Unlock()
+	if !exists || dl.Status != "completed" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Download not found or not completed"})
+		return
+	}
+	if _, err := os.Stat(dl.Filepath); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File no longer exists on disk"})
+		return
+	}
+
+	c.FileAttachment(dl.Filepath, dl.Filename)
+}
+
+// browseEntry is a single file/directory listed by GET /browse/*path.
+type browseEntry struct {
+	Name  string `json:"name"`
+	IsDir bool   `json:"is_dir"`
+	Size  int64  `json:"size"`
+}
+
+// browseDir lists the tree under downloadDir as JSON so a web UI can pick
+// items for /archive without needing filesystem access of its own.
+func browseDir(c *gin.Context) {
+	requested := strings.TrimPrefix(c.Param("path"), "/")
+	target := filepath.Join(downloadDir, filepath.Clean("/"+requested))
+	if !strings.HasPrefix(target, filepath.Clean(downloadDir)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path"})
+		return
+	}
+
+	entries, err := os.ReadDir(target)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Path not found"})
+		return
+	}
+
+	list := make([]browseEntry, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		list = append(list, browseEntry{Name: entry.Name(), IsDir: entry.IsDir(), Size: info.Size()})
+	}
+	c.JSON(http.StatusOK, list)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// expectedDigest is a hash extracted from an origin response's ETag,
+// Digest, or Content-MD5 header that a completed download's body should
+// match.
+type expectedDigest struct {
+	algo  string // "sha256" or "md5"
+	value string // lowercase hex
+}
+
+// extractExpectedDigest looks for a strong ETag, a Digest header, or a
+// Content-MD5 header that encodes a hex or base64 MD5/SHA-256 digest.
+func extractExpectedDigest(h http.Header) *expectedDigest {
+	if digest := h.Get("Digest"); digest != "" {
+		for _, part := range strings.Split(digest, ",") {
+			kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			algo := strings.ToLower(strings.TrimSpace(kv[0]))
+			value := decodeDigestValue(strings.TrimSpace(kv[1]))
+			switch algo {
+			case "sha-256":
+				if len(value) == 64 {
+					return &expectedDigest{algo: "sha256", value: value}
+				}
+			case "md5":
+				if len(value) == 32 {
+					return &expectedDigest{algo: "md5", value: value}
+				}
+			}
+		}
+	}
+
+	if md5Header := h.Get("Content-MD5"); md5Header != "" {
+		if value := decodeDigestValue(md5Header); len(value) == 32 {
+			return &expectedDigest{algo: "md5", value: value}
+		}
+	}
+
+	// A weak ETag (the "W/" prefix) isn't guaranteed to be byte-identical
+	// across requests, so it can't be used as a content digest the way a
+	// strong ETag can; skip it rather than stripping the prefix and
+	// treating it as strong.
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		value := decodeDigestValue(etag)
+		switch len(value) {
+		case 64:
+			return &expectedDigest{algo: "sha256", value: value}
+		case 32:
+			return &expectedDigest{algo: "md5", value: value}
+		}
+	}
+
+	return nil
+}
+
+// decodeDigestValue accepts either a hex or base64-encoded digest and
+// returns its lowercase hex form, or "" if it's neither.
+func decodeDigestValue(s string) string {
+	s = strings.Trim(s, `"`)
+	if isHex(strings.ToLower(s)) {
+		return strings.ToLower(s)
+	}
+	if raw, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return hex.EncodeToString(raw)
+	}
+	return ""
+}
+
+func isHex(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !((r >= '0' && r <= '9') || (r >= 'a' && r <= 'f')) {
+			return false
+		}
+	}
+	return true
+}
+
+// checksumMismatch reports whether the actual body hashes or size fail to
+// match an explicitly requested sha256/size or a digest advertised by the
+// origin server.
+func checksumMismatch(shaHex, md5Hex string, actualSize int64, expected *expectedDigest, expectedSHA256 string, expectedSize int64) bool {
+	if expectedSHA256 != "" && !strings.EqualFold(expectedSHA256, shaHex) {
+		return true
+	}
+	if expectedSize != 0 && actualSize != expectedSize {
+		return true
+	}
+	if expected != nil {
+		switch expected.algo {
+		case "sha256":
+			return !strings.EqualFold(expected.value, shaHex)
+		case "md5":
+			return !strings.EqualFold(expected.value, md5Hex)
+		}
+	}
+	return false
+}
+
+// finishDownload records the final path, checksum, and status of a
+// completed (or corrupt) download and notifies any WS subscribers.
+func finishDownload(id, status, finalPath, checksum string) {
+	downloadsMu.Lock()
+	dl, exists := downloads[id]
+	if exists {
+		dl.Filepath = finalPath
+		dl.Checksum = checksum
+		dl.Status = status
+	}
+	downloadsMu.Unlock()
+	if exists {
+		persistDownload(dl, true)
+	}
+	emitUpdate(id, true)
+}
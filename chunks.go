@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// numChunks is the number of concurrent range requests used for a segmented
+// download when the origin server advertises range support.
+const numChunks = 8
+
+// sidecarFlushEvery controls how often (in bytes written across all chunks)
+// a download's chunk progress is persisted to its sidecar file, so a crash
+// loses at most this much work.
+const sidecarFlushEvery = 4 * 1024 * 1024 // 4 MiB
+
+// chunkState is the on-disk record for a single chunk of a segmented
+// download, persisted as part of the sidecar JSON.
+type chunkState struct {
+	Start   int64 `json:"start"`
+	End     int64 `json:"end"`
+	Written int64 `json:"written"`
+}
+
+// sidecar is the small JSON file written alongside a segmented download's
+// part files so it can be resumed across restarts.
+type sidecar struct {
+	ID     string       `json:"id"`
+	URL    string       `json:"url"`
+	Size   int64        `json:"size"`
+	Chunks []chunkState `json:"chunks"`
+
+	// ExpectedDigestAlgo/Value come from the origin's ETag/Digest headers
+	// at probe time; ExpectedSHA256 comes from the /add request body.
+	// Both are carried in the sidecar so a resumed download can still be
+	// verified without re-probing.
+	ExpectedDigestAlgo  string `json:"expected_digest_algo,omitempty"`
+	ExpectedDigestValue string `json:"expected_digest_value,omitempty"`
+	ExpectedSHA256      string `json:"expected_sha256,omitempty"`
+	ExpectedSize        int64  `json:"expected_size,omitempty"`
+}
+
+var (
+	cancelFuncs   = make(map[string]context.CancelFunc)
+	cancelFuncsMu sync.Mutex
+)
+
+func partsDir(id string) string {
+	return filepath.Join(downloadDir, "temp", id)
+}
+
+func sidecarPath(id string) string {
+	return filepath.Join(partsDir(id), "sidecar.json")
+}
+
+func partPath(id string, n int) string {
+	return filepath.Join(partsDir(id), fmt.Sprintf("%s.part%d", id, n))
+}
+
+func loadSidecar(id string) (*sidecar, error) {
+	data, err := os.ReadFile(sidecarPath(id))
+	if err != nil {
+		return nil, err
+	}
+	var sc sidecar
+	if err := json.Unmarshal(data, &sc); err != nil {
+		return nil, err
+	}
+	return &sc, nil
+}
+
+func saveSidecar(sc *sidecar) error {
+	data, err := json.Marshal(sc)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(sidecarPath(sc.ID), data, 0644)
+}
+
+// probeRangeSupport issues a HEAD request (falling back to a ranged GET) to
+// determine whether the origin supports byte ranges and, if so, the total
+// content length. reqHeaders carries any extra headers a Resolver says are
+// needed to fetch fileURL (see Download.Headers).
+func probeRangeSupport(fileURL string, reqHeaders map[string]string) (supported bool, size int64, contentType string, headers http.Header) {
+	headReq, err := http.NewRequest(http.MethodHead, fileURL, nil)
+	if err != nil {
+		return false, 0, "", nil
+	}
+	for k, v := range reqHeaders {
+		headReq.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(headReq)
+	if err != nil || resp.StatusCode >= 400 {
+		req, rerr := http.NewRequest(http.MethodGet, fileURL, nil)
+		if rerr != nil {
+			return false, 0, "", nil
+		}
+		for k, v := range reqHeaders {
+			req.Header.Set(k, v)
+		}
+		req.Header.Set("Range", "bytes=0-0")
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			return false, 0, "", nil
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusPartialContent {
+			return false, 0, "", nil
+		}
+		if cr := resp.Header.Get("Content-Range"); cr != "" {
+			var total int64
+			if _, serr := fmt.Sscanf(cr, "bytes 0-0/%d", &total); serr == nil {
+				return true, total, resp.Header.Get("Content-Type"), resp.Header
+			}
+		}
+		return false, 0, "", nil
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Accept-Ranges") != "bytes" {
+		return false, 0, "", nil
+	}
+	return true, resp.ContentLength, resp.Header.Get("Content-Type"), resp.Header
+}
+
+// chunkProgress is sent on the shared progress channel by each chunk
+// goroutine as it writes bytes, so a single collector can update the
+// Download struct and throttle sidecar flushes without per-chunk locking.
+type chunkProgress struct {
+	chunkIndex int
+	written    int64
+}
+
+// startSegmentedDownload splits fileURL into numChunks ranged downloads and
+// reassembles them into finalPath once all chunks complete. The caller
+// (startDownload) decides beforehand whether the origin supports ranges;
+// failures here mark the download "failed" rather than falling back to the
+// single-stream path. reqHeaders is re-sent on every chunk request, same
+// as the single-stream path.
+func startSegmentedDownload(id, fileURL string, size int64, filename, finalPath string, respHeaders http.Header, reqHeaders map[string]string) {
+	if err := os.MkdirAll(partsDir(id), 0755); err != nil {
+		updateStatus(id, "failed")
+		return
+	}
+
+	chunkSize := size / numChunks
+	chunks := make([]chunkState, numChunks)
+	for i := 0; i < numChunks; i++ {
+		start := int64(i) * chunkSize
+		end := start + chunkSize - 1
+		if i == numChunks-1 {
+			end = size - 1
+		}
+		chunks[i] = chunkState{Start: start, End: end}
+	}
+
+	sc := &sidecar{ID: id, URL: fileURL, Size: size, Chunks: chunks}
+	if expected := extractExpectedDigest(respHeaders); expected != nil {
+		sc.ExpectedDigestAlgo = expected.algo
+		sc.ExpectedDigestValue = expected.value
+	}
+	downloadsMu.Lock()
+	sc.ExpectedSHA256 = downloads[id].ExpectedSHA256
+	sc.ExpectedSize = downloads[id].ExpectedSize
+	downloadsMu.Unlock()
+
+	if err := saveSidecar(sc); err != nil {
+		updateStatus(id, "failed")
+		return
+	}
+
+	runSegmentedDownload(id, fileURL, filename, finalPath, sc, reqHeaders)
+}
+
+// resumeSegmentedDownload reopens an existing sidecar and continues any
+// chunks that were not fully written.
+func resumeSegmentedDownload(id string, sc *sidecar) {
+	downloadsMu.Lock()
+	dl, exists := downloads[id]
+	var reqHeaders map[string]string
+	if exists {
+		reqHeaders = dl.Headers
+	}
+	downloadsMu.Unlock()
+	if !exists {
+		return
+	}
+	runSegmentedDownload(id, sc.URL, dl.Filename, dl.Filepath, sc, reqHeaders)
+}
+
+func runSegmentedDownload(id, fileURL, filename, finalPath string, sc *sidecar, reqHeaders map[string]string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelFuncsMu.Lock()
+	cancelFuncs[id] = cancel
+	cancelFuncsMu.Unlock()
+	defer func() {
+		cancelFuncsMu.Lock()
+		delete(cancelFuncs, id)
+		cancelFuncsMu.Unlock()
+	}()
+
+	progressCh := make(chan chunkProgress, numChunks)
+	done := make(chan error, numChunks)
+
+	for i, cs := range sc.Chunks {
+		go downloadChunk(ctx, id, fileURL, i, cs, reqHeaders, progressCh, done)
+	}
+
+	var sizeCurrent int64
+	for _, cs := range sc.Chunks {
+		sizeCurrent += cs.Written
+	}
+	startTime := time.Now()
+	var sinceFlush int64
+	remaining := len(sc.Chunks)
+	failed := false
+
+	for remaining > 0 {
+		select {
+		case p := <-progressCh:
+			delta := p.written - sc.Chunks[p.chunkIndex].Written
+			sc.Chunks[p.chunkIndex].Written = p.written
+			sizeCurrent += delta
+			sinceFlush += delta
+
+			duration := time.Since(startTime).Seconds()
+			downloadsMu.Lock()
+			dl, ok := downloads[id]
+			if ok {
+				dl.SizeCurrent = sizeCurrent
+				dl.Progress = (float64(sizeCurrent) / float64(sc.Size)) * 100
+				if duration > 0 {
+					dl.Speed = int64(float64(sizeCurrent) / duration)
+				}
+			}
+			downloadsMu.Unlock()
+			if ok {
+				persistDownload(dl, false)
+			}
+			emitUpdate(id, false)
+
+			if sinceFlush >= sidecarFlushEvery {
+				saveSidecar(sc)
+				sinceFlush = 0
+			}
+		case err := <-done:
+			remaining--
+			if err != nil && err != context.Canceled {
+				failed = true
+			}
+		}
+	}
+
+	saveSidecar(sc)
+
+	if ctx.Err() == context.Canceled {
+		updateStatus(id, "paused")
+		return
+	}
+	if failed {
+		updateStatus(id, "failed")
+		return
+	}
+
+	shaHex, md5Hex, err := concatenateParts(id, finalPath, len(sc.Chunks))
+	if err != nil {
+		updateStatus(id, "failed")
+		return
+	}
+
+	var expected *expectedDigest
+	if sc.ExpectedDigestAlgo != "" {
+		expected = &expectedDigest{algo: sc.ExpectedDigestAlgo, value: sc.ExpectedDigestValue}
+	}
+	if checksumMismatch(shaHex, md5Hex, sizeCurrent, expected, sc.ExpectedSHA256, sc.ExpectedSize) {
+		corruptPath := finalPath + ".corrupt"
+		os.Rename(finalPath, corruptPath)
+		os.RemoveAll(partsDir(id))
+		finishDownload(id, "corrupt", corruptPath, shaHex)
+		return
+	}
+
+	os.RemoveAll(partsDir(id))
+	finishDownload(id, "completed", finalPath, shaHex)
+}
+
+func downloadChunk(ctx context.Context, id, fileURL string, index int, cs chunkState, reqHeaders map[string]string, progressCh chan<- chunkProgress, done chan<- error) {
+	start := cs.Start + cs.Written
+	if start > cs.End {
+		done <- nil
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		done <- err
+		return
+	}
+	for k, v := range reqHeaders {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, cs.End))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		done <- err
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		done <- fmt.Errorf("chunk %d: server returned status %d", index, resp.StatusCode)
+		return
+	}
+
+	partFile, err := os.OpenFile(partPath(id, index), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		done <- err
+		return
+	}
+	defer partFile.Close()
+	if _, err := partFile.Seek(cs.Written, io.SeekStart); err != nil {
+		done <- err
+		return
+	}
+
+	written := cs.Written
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := partFile.Write(buf[:n]); werr != nil {
+				done <- werr
+				return
+			}
+			written += int64(n)
+			progressCh <- chunkProgress{chunkIndex: index, written: written}
+		}
+		if rerr == io.EOF {
+			done <- nil
+			return
+		}
+		if rerr != nil {
+			if ctx.Err() == context.Canceled {
+				done <- context.Canceled
+			} else {
+				done <- rerr
+			}
+			return
+		}
+	}
+}
+
+// concatenateParts joins a segmented download's part files into finalPath
+// in order, returning the sha256 and md5 hex digests of the assembled body
+// so the result can be checked against an expected/origin digest.
+func concatenateParts(id, finalPath string, parts int) (shaHex, md5Hex string, err error) {
+	outFile, err := os.Create(finalPath)
+	if err != nil {
+		return "", "", err
+	}
+	defer outFile.Close()
+
+	sha256Hasher := sha256.New()
+	md5Hasher := md5.New()
+	writer := io.MultiWriter(outFile, sha256Hasher, md5Hasher)
+
+	for i := 0; i < parts; i++ {
+		partFile, err := os.Open(partPath(id, i))
+		if err != nil {
+			return "", "", err
+		}
+		_, err = io.Copy(writer, partFile)
+		partFile.Close()
+		if err != nil {
+			return "", "", err
+		}
+	}
+	return hex.EncodeToString(sha256Hasher.Sum(nil)), hex.EncodeToString(md5Hasher.Sum(nil)), nil
+}
+
+// pauseDownload cancels an in-flight download's context, leaving its part
+// files and sidecar on disk for a later /resume/:id.
+func pauseDownload(c *gin.Context) {
+	id := c.Param("id")
+
+	cancelFuncsMu.Lock()
+	cancel, exists := cancelFuncs[id]
+	cancelFuncsMu.Unlock()
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Download not in progress"})
+		return
+	}
+	cancel()
+
+	c.JSON(http.StatusOK, gin.H{"message": "Download paused", "id": id})
+}
+
+// resumeDownload reopens a paused download's sidecar and re-issues ranged
+// GETs for whatever each chunk still has left to fetch.
+func resumeDownload(c *gin.Context) {
+	id := c.Param("id")
+
+	downloadsMu.Lock()
+	dl, exists := downloads[id]
+	downloadsMu.Unlock()
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Download not found"})
+		return
+	}
+	if dl.Status != "paused" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Download is not paused"})
+		return
+	}
+
+	// Only one resume of a download can run at a time: if a
+	// runSegmentedDownload for this ID is still registered, a prior resume (or the original run)
+	// never stopped, and starting a second one would race two sets of
+	// downloadChunk goroutines over the same part files and clobber
+	// cancelFuncs[id]. The slot is reserved here, under the same lock as
+	// the check, rather than left for runSegmentedDownload to set later:
+	// that goroutine only starts (and registers its real cancel func)
+	// after this handler returns, so two concurrent /resume/:id requests
+	// would otherwise both see cancelFuncs[id] absent and both proceed.
+	cancelFuncsMu.Lock()
+	if _, alreadyRunning := cancelFuncs[id]; alreadyRunning {
+		cancelFuncsMu.Unlock()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Download is already in progress"})
+		return
+	}
+	cancelFuncs[id] = func() {}
+	cancelFuncsMu.Unlock()
+
+	sc, err := loadSidecar(id)
+	if err != nil {
+		cancelFuncsMu.Lock()
+		delete(cancelFuncs, id)
+		cancelFuncsMu.Unlock()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No resumable state for this download"})
+		return
+	}
+
+	updateStatus(id, "in_progress")
+	go resumeSegmentedDownload(id, sc)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Download resumed", "id": dl.ID})
+}
+
+// recoverSegmentedDownloads scans the temp directory for sidecars left by an
+// unclean shutdown and registers them as paused downloads the user can
+// resume via POST /resume/:id.
+func recoverSegmentedDownloads() {
+	tempDir := filepath.Join(downloadDir, "temp")
+	entries, err := os.ReadDir(tempDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		id := entry.Name()
+
+		downloadsMu.Lock()
+		_, alreadyLoaded := downloads[id]
+		downloadsMu.Unlock()
+		if alreadyLoaded {
+			continue
+		}
+
+		sc, err := loadSidecar(id)
+		if err != nil {
+			continue
+		}
+
+		var written int64
+		for _, cs := range sc.Chunks {
+			written += cs.Written
+		}
+
+		filename := getFilename(nil, sc.URL)
+		finalPath := filepath.Join(getCategoryDir(filename, ""), filename)
+
+		downloadsMu.Lock()
+		downloads[id] = &Download{
+			ID:          id,
+			URL:         sc.URL,
+			Filename:    filename,
+			Filepath:    finalPath,
+			Status:      "paused",
+			SizeCurrent: written,
+			SizeTotal:   sc.Size,
+			Progress:    (float64(written) / float64(sc.Size)) * 100,
+		}
+		dl := downloads[id]
+		downloadsMu.Unlock()
+		persistDownload(dl, true)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// TestSidecarSaveLoadRoundTrip exercises the sidecar persistence a
+// pause/resume cycle depends on: everything written by saveSidecar,
+// including in-flight chunk progress and expected-digest fields, must
+// come back unchanged from loadSidecar.
+func TestSidecarSaveLoadRoundTrip(t *testing.T) {
+	orig := downloadDir
+	downloadDir = t.TempDir()
+	defer func() { downloadDir = orig }()
+
+	sc := &sidecar{
+		ID:   "test-id",
+		URL:  "http://example.com/file.bin",
+		Size: 1024,
+		Chunks: []chunkState{
+			{Start: 0, End: 511, Written: 512},
+			{Start: 512, End: 1023, Written: 100},
+		},
+		ExpectedDigestAlgo:  "sha256",
+		ExpectedDigestValue: "deadbeef",
+		ExpectedSHA256:      "feedface",
+		ExpectedSize:        1024,
+	}
+
+	if err := os.MkdirAll(partsDir(sc.ID), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := saveSidecar(sc); err != nil {
+		t.Fatalf("saveSidecar: %v", err)
+	}
+
+	loaded, err := loadSidecar(sc.ID)
+	if err != nil {
+		t.Fatalf("loadSidecar: %v", err)
+	}
+	if loaded.ID != sc.ID || loaded.URL != sc.URL || loaded.Size != sc.Size {
+		t.Fatalf("round trip mismatch: got %+v, want %+v", loaded, sc)
+	}
+	if len(loaded.Chunks) != len(sc.Chunks) {
+		t.Fatalf("chunk count mismatch: got %d, want %d", len(loaded.Chunks), len(sc.Chunks))
+	}
+	for i, c := range loaded.Chunks {
+		if c != sc.Chunks[i] {
+			t.Errorf("chunk %d mismatch: got %+v, want %+v", i, c, sc.Chunks[i])
+		}
+	}
+	if loaded.ExpectedDigestAlgo != sc.ExpectedDigestAlgo || loaded.ExpectedDigestValue != sc.ExpectedDigestValue {
+		t.Fatalf("expected digest fields did not round-trip: got %+v", loaded)
+	}
+	if loaded.ExpectedSHA256 != sc.ExpectedSHA256 || loaded.ExpectedSize != sc.ExpectedSize {
+		t.Fatalf("expected sha256/size fields did not round-trip: got %+v", loaded)
+	}
+}
+
+// TestDownloadChunkResumesFromPartialWrite seeds a part file as if a prior
+// run had already written its first few bytes, then checks that
+// downloadChunk requests only the remaining range and appends to (rather
+// than overwrites) what's already on disk.
+func TestDownloadChunkResumesFromPartialWrite(t *testing.T) {
+	orig := downloadDir
+	downloadDir = t.TempDir()
+	defer func() { downloadDir = orig }()
+
+	const id = "resume-test"
+	full := []byte("0123456789ABCDEF")
+	const alreadyWritten = 6
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Range"); got != "bytes=6-15" {
+			t.Errorf("expected a range request for the unwritten tail, got %q", got)
+		}
+		w.Header().Set("Content-Range", "bytes 6-15/16")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(full[alreadyWritten:])
+	}))
+	defer srv.Close()
+
+	if err := os.MkdirAll(partsDir(id), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := os.WriteFile(partPath(id, 0), full[:alreadyWritten], 0644); err != nil {
+		t.Fatalf("seed part file: %v", err)
+	}
+
+	cs := chunkState{Start: 0, End: int64(len(full) - 1), Written: alreadyWritten}
+	progressCh := make(chan chunkProgress, len(full))
+	done := make(chan error, 1)
+
+	downloadChunk(context.Background(), id, srv.URL, 0, cs, nil, progressCh, done)
+
+	if err := <-done; err != nil {
+		t.Fatalf("downloadChunk returned error: %v", err)
+	}
+
+	got, err := os.ReadFile(partPath(id, 0))
+	if err != nil {
+		t.Fatalf("reading part file: %v", err)
+	}
+	if string(got) != string(full) {
+		t.Fatalf("part file content = %q, want %q", got, full)
+	}
+}
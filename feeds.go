@@ -0,0 +1,416 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Feed is a subscribed RSS/Atom feed polled on Interval for new enclosures.
+type Feed struct {
+	ID       string `json:"id"`
+	URL      string `json:"url"`
+	Title    string `json:"title"`
+	Interval int    `json:"interval"` // seconds
+	Filter   string `json:"filter,omitempty"`
+
+	filterRe *regexp.Regexp
+	stop     chan struct{}
+}
+
+var (
+	feeds   = make(map[string]*Feed)
+	feedsMu sync.Mutex
+)
+
+func feedsDir() string {
+	dir := filepath.Join(downloadDir, "feeds")
+	os.MkdirAll(dir, 0755)
+	return dir
+}
+
+func seenPath(feedID string) string {
+	return filepath.Join(feedsDir(), feedID+".seen.json")
+}
+
+func loadSeen(feedID string) map[string]bool {
+	seen := make(map[string]bool)
+	data, err := os.ReadFile(seenPath(feedID))
+	if err != nil {
+		return seen
+	}
+	var keys []string
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return seen
+	}
+	for _, k := range keys {
+		seen[k] = true
+	}
+	return seen
+}
+
+func addSeen(feedID, key string) {
+	seen := loadSeen(feedID)
+	seen[key] = true
+	keys := make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return
+	}
+	os.WriteFile(seenPath(feedID), data, 0644)
+}
+
+func addFeed(c *gin.Context) {
+	var req struct {
+		URL      string `json:"url"`
+		Interval int    `json:"interval"`
+		Filter   string `json:"filter"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	if req.URL == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "url is required"})
+		return
+	}
+	if req.Interval <= 0 {
+		req.Interval = 900 // 15 minutes
+	}
+
+	var filterRe *regexp.Regexp
+	if req.Filter != "" {
+		re, err := regexp.Compile(req.Filter)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid filter regex"})
+			return
+		}
+		filterRe = re
+	}
+
+	// The ID is derived from the URL, not minted fresh, so that re-POSTing
+	// the same feed (after a restart that lost the in-memory map, or just
+	// to change the interval/filter) reuses the existing seen-set instead
+	// of orphaning it and re-downloading the whole back-catalog.
+	id := hashKey(req.URL)
+	feed := &Feed{
+		ID:       id,
+		URL:      req.URL,
+		Interval: req.Interval,
+		Filter:   req.Filter,
+		filterRe: filterRe,
+		stop:     make(chan struct{}),
+	}
+
+	feedsMu.Lock()
+	if existing, ok := feeds[id]; ok {
+		close(existing.stop)
+	}
+	feeds[id] = feed
+	feedsMu.Unlock()
+
+	persistFeed(feed)
+	go pollFeedLoop(feed)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Feed subscribed", "id": id})
+}
+
+// persistFeed writes feed through to the Store so subscriptions survive a
+// restart. Best-effort, like persistDownload: a failure here is only
+// logged, and a subscription that was never persisted is not restored
+// after a restart.
+func persistFeed(feed *Feed) {
+	if store == nil {
+		return
+	}
+	feedsMu.Lock()
+	snapshot := *feed
+	feedsMu.Unlock()
+	if err := store.PutFeed(&snapshot); err != nil {
+		log.Println("Error persisting feed:", feed.ID, err)
+	}
+}
+
+// loadFeeds rehydrates subscriptions from the Store on startup and resumes
+// polling each one, picking up from its existing seen-set.
+func loadFeeds() {
+	records, err := store.ListFeeds()
+	if err != nil {
+		log.Println("Error loading persisted feeds:", err)
+		return
+	}
+
+	for _, f := range records {
+		if f.Filter != "" {
+			if re, err := regexp.Compile(f.Filter); err == nil {
+				f.filterRe = re
+			}
+		}
+		f.stop = make(chan struct{})
+
+		feedsMu.Lock()
+		feeds[f.ID] = f
+		feedsMu.Unlock()
+
+		go pollFeedLoop(f)
+	}
+}
+
+func getFeeds(c *gin.Context) {
+	feedsMu.Lock()
+	defer feedsMu.Unlock()
+
+	list := make([]Feed, 0, len(feeds))
+	for _, f := range feeds {
+		list = append(list, Feed{ID: f.ID, URL: f.URL, Title: f.Title, Interval: f.Interval, Filter: f.Filter})
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+func deleteFeed(c *gin.Context) {
+	id := c.Param("id")
+
+	feedsMu.Lock()
+	feed, exists := feeds[id]
+	if exists {
+		delete(feeds, id)
+	}
+	feedsMu.Unlock()
+
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Feed not found"})
+		return
+	}
+	close(feed.stop)
+	if store != nil {
+		if err := store.DeleteFeed(id); err != nil {
+			log.Println("Error deleting persisted feed:", id, err)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Feed removed"})
+}
+
+func pollFeedLoop(feed *Feed) {
+	pollFeedOnce(feed)
+
+	ticker := time.NewTicker(time.Duration(feed.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pollFeedOnce(feed)
+		case <-feed.stop:
+			return
+		}
+	}
+}
+
+func pollFeedOnce(feed *Feed) {
+	resp, err := http.Get(feed.URL)
+	if err != nil {
+		log.Println("Error fetching feed:", feed.URL, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Println("Error reading feed:", feed.URL, err)
+		return
+	}
+
+	title, items, err := parseFeed(body)
+	if err != nil {
+		log.Println("Error parsing feed:", feed.URL, err)
+		return
+	}
+	if title != "" {
+		feedsMu.Lock()
+		feed.Title = title
+		feedsMu.Unlock()
+		persistFeed(feed)
+	}
+
+	seen := loadSeen(feed.ID)
+	for _, item := range items {
+		if item.EnclosureURL == "" {
+			continue
+		}
+		if feed.filterRe != nil && !feed.filterRe.MatchString(item.Title) {
+			continue
+		}
+
+		key := item.GUID
+		if key == "" {
+			key = item.EnclosureURL
+		}
+		key = hashKey(key)
+		if seen[key] {
+			continue
+		}
+
+		enqueueFeedItem(feed, item)
+		addSeen(feed.ID, key)
+		seen[key] = true
+	}
+}
+
+func hashKey(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func enqueueFeedItem(feed *Feed, item feedItem) {
+	categoryName := feed.Title
+	if categoryName == "" {
+		categoryName = feed.ID
+	}
+	categoryDir := filepath.Join(downloadDir, "podcasts", categoryName)
+	os.MkdirAll(categoryDir, 0755)
+
+	filename := getFilename(nil, item.EnclosureURL)
+
+	// The collision check and the insert below must happen under one
+	// lock acquisition: pollFeedLoop runs one goroutine per feed, so two
+	// items with the same computed filename can be enqueued back-to-back
+	// before either download has written anything to categoryDir.
+	// os.Stat alone would see an empty directory for both and hand out
+	// the same final path; checking the in-flight downloads too closes
+	// that race.
+	downloadsMu.Lock()
+
+	for _, dl := range downloads {
+		if dl.URL == item.EnclosureURL {
+			downloadsMu.Unlock()
+			return
+		}
+	}
+	if _, err := os.Stat(filepath.Join(categoryDir, filename)); err == nil {
+		filename = fmt.Sprintf("%s_%s", item.PubDate, filename)
+	}
+	for _, dl := range downloads {
+		if dl.CategoryOverride == categoryDir && dl.FilenameOverride == filename {
+			filename = fmt.Sprintf("%s_%s", item.PubDate, filename)
+			break
+		}
+	}
+
+	id := fmt.Sprintf("%d", time.Now().UnixNano())
+	downloads[id] = &Download{
+		ID:               id,
+		URL:              item.EnclosureURL,
+		Status:           "in_progress",
+		CategoryOverride: categoryDir,
+		FilenameOverride: filename,
+	}
+	dl := downloads[id]
+	downloadsMu.Unlock()
+	persistDownload(dl, true)
+
+	go startDownload(id, item.EnclosureURL)
+}
+
+// feedItem is a single enclosure-bearing entry parsed out of an RSS <item>
+// or Atom <entry>.
+type feedItem struct {
+	Title        string
+	GUID         string
+	PubDate      string
+	EnclosureURL string
+	MimeHint     string
+}
+
+type rssDocument struct {
+	XMLName xml.Name `xml:"rss"`
+	Channel struct {
+		Title string    `xml:"title"`
+		Items []rssItem `xml:"item"`
+	} `xml:"channel"`
+}
+
+type rssItem struct {
+	Title     string `xml:"title"`
+	GUID      string `xml:"guid"`
+	PubDate   string `xml:"pubDate"`
+	Enclosure struct {
+		URL  string `xml:"url,attr"`
+		Type string `xml:"type,attr"`
+	} `xml:"enclosure"`
+}
+
+type atomDocument struct {
+	XMLName xml.Name    `xml:"feed"`
+	Title   string      `xml:"title"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	Title   string `xml:"title"`
+	ID      string `xml:"id"`
+	Updated string `xml:"updated"`
+	Links   []struct {
+		Rel  string `xml:"rel,attr"`
+		Href string `xml:"href,attr"`
+		Type string `xml:"type,attr"`
+	} `xml:"link"`
+}
+
+// parseFeed accepts either an RSS or an Atom document and returns its title
+// plus every enclosure-bearing item/entry.
+func parseFeed(data []byte) (title string, items []feedItem, err error) {
+	var rss rssDocument
+	if err := xml.Unmarshal(data, &rss); err == nil && rss.XMLName.Local == "rss" {
+		title = rss.Channel.Title
+		for _, it := range rss.Channel.Items {
+			if it.Enclosure.URL == "" {
+				continue
+			}
+			items = append(items, feedItem{
+				Title:        it.Title,
+				GUID:         it.GUID,
+				PubDate:      it.PubDate,
+				EnclosureURL: it.Enclosure.URL,
+				MimeHint:     it.Enclosure.Type,
+			})
+		}
+		return title, items, nil
+	}
+
+	var atom atomDocument
+	if err := xml.Unmarshal(data, &atom); err == nil && atom.XMLName.Local == "feed" {
+		title = atom.Title
+		for _, entry := range atom.Entries {
+			for _, link := range entry.Links {
+				if link.Rel != "enclosure" {
+					continue
+				}
+				items = append(items, feedItem{
+					Title:        entry.Title,
+					GUID:         entry.ID,
+					PubDate:      entry.Updated,
+					EnclosureURL: link.Href,
+					MimeHint:     link.Type,
+				})
+			}
+		}
+		return title, items, nil
+	}
+
+	return "", nil, fmt.Errorf("unrecognized feed format")
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
@@ -9,6 +12,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -26,21 +30,46 @@ type Download struct {
 	SizeTotal   int64   `json:"size_total"`
 	Progress    float64 `json:"progress"`
 	Speed       int64   `json:"speed"`
+	Checksum    string  `json:"checksum,omitempty"`
+
+	// ExpectedSHA256 and ExpectedSize let a caller that already knows a
+	// file's hash (magnet-style links, package managers) enforce it;
+	// a mismatch marks the download "corrupt" instead of "completed".
+	ExpectedSHA256 string `json:"expected_sha256,omitempty"`
+	ExpectedSize   int64  `json:"expected_size,omitempty"`
+
+	// CategoryOverride and FilenameOverride let callers outside of /add
+	// (e.g. the feed subscriber) route a download to a specific directory
+	// and filename instead of the mime-based category switch.
+	CategoryOverride string `json:"-"`
+	FilenameOverride string `json:"-"`
+
+	// Headers carries any extra request headers a Resolver says are
+	// needed to fetch the resolved URL (e.g. a CDN that requires a
+	// specific Referer or User-Agent).
+	Headers map[string]string `json:"-"`
 }
 
 var (
 	downloads   = make(map[string]*Download)
 	downloadsMu sync.Mutex
 	downloadDir = filepath.Join(os.Getenv("HOME"), "Downloads", "GoLoad")
+	store       Store
 )
 
 func init() {
-	os.MkdirAll(downloadDir, 0755)
-	err := os.RemoveAll(downloadDir)
+	os.MkdirAll(filepath.Join(downloadDir, "temp"), 0755)
+
+	s, err := openStore(storePath())
 	if err != nil {
-		log.Println("Error clearing GoLoad directory:", err)
+		log.Println("Error opening download store:", err)
+	} else {
+		store = s
+		loadDownloads()
+		loadFeeds()
 	}
-	os.MkdirAll(filepath.Join(downloadDir, "temp"), 0755)
+
+	recoverSegmentedDownloads()
 }
 
 func cleanInvalidDownloads() {
@@ -50,6 +79,9 @@ func cleanInvalidDownloads() {
 		if dl.Filepath != "" && dl.Status == "completed" {
 			if _, err := os.Stat(dl.Filepath); os.IsNotExist(err) {
 				delete(downloads, id)
+				if store != nil {
+					store.Delete(id)
+				}
 			}
 		}
 	}
@@ -58,7 +90,10 @@ func cleanInvalidDownloads() {
 func addDownload(c *gin.Context) {
 	cleanInvalidDownloads()
 	var req struct {
-		URL string `json:"url"`
+		URL            string `json:"url"`
+		ExpectedSHA256 string `json:"expected_sha256"`
+		ExpectedSize   int64  `json:"expected_size"`
+		Quality        string `json:"quality"`
 	}
 
 	if err := c.BindJSON(&req); err != nil {
@@ -77,25 +112,98 @@ func addDownload(c *gin.Context) {
 
 	id := fmt.Sprintf("%d", time.Now().UnixNano())
 	downloadsMu.Lock()
-	downloads[id] = &Download{ID: id, URL: req.URL, Status: "in_progress"}
+	downloads[id] = &Download{
+		ID:             id,
+		URL:            req.URL,
+		Status:         "in_progress",
+		ExpectedSHA256: strings.ToLower(req.ExpectedSHA256),
+		ExpectedSize:   req.ExpectedSize,
+	}
+	dl := downloads[id]
 	downloadsMu.Unlock()
+	persistDownload(dl, true)
 
-	go startDownload(id, req.URL)
+	go resolveAndDownload(id, req.URL, req.Quality)
 
 	c.JSON(http.StatusOK, gin.H{"message": "Download started", "id": id})
 }
 
 func startDownload(id, fileURL string) {
-	resp, err := http.Get(fileURL)
+	downloadsMu.Lock()
+	categoryOverride := downloads[id].CategoryOverride
+	filenameOverride := downloads[id].FilenameOverride
+	reqHeaders := downloads[id].Headers
+	downloadsMu.Unlock()
+
+	if rangeSupported, size, contentType, respHeaders := probeRangeSupport(fileURL, reqHeaders); rangeSupported && size >= numChunks {
+		filename := filenameOverride
+		if filename == "" {
+			filename = getFilename(nil, fileURL)
+		}
+		categoryDir := categoryOverride
+		if categoryDir == "" {
+			categoryDir = getCategoryDir(filename, contentType)
+		}
+		finalPath := filepath.Join(categoryDir, filename)
+
+		downloadsMu.Lock()
+		downloads[id].Filename = filename
+		downloads[id].Filepath = finalPath
+		downloads[id].SizeTotal = size
+		dl := downloads[id]
+		downloadsMu.Unlock()
+
+		// Force a write-through now: runSegmentedDownload's first
+		// persistDownload only happens on the first progressCh tick, so a
+		// crash before that point would otherwise leave the stored record
+		// in_progress with an empty Filename/Filepath, which
+		// resumeSegmentedDownload can't resume against.
+		persistDownload(dl, true)
+
+		startSegmentedDownload(id, fileURL, size, filename, finalPath, respHeaders, reqHeaders)
+		return
+	}
+
+	startSingleStreamDownload(id, fileURL)
+}
+
+// startSingleStreamDownload is the fallback path for servers that don't
+// advertise range support: a single unbuffered GET, as GoLoad has always
+// done.
+func startSingleStreamDownload(id, fileURL string) {
+	downloadsMu.Lock()
+	categoryOverride := downloads[id].CategoryOverride
+	filenameOverride := downloads[id].FilenameOverride
+	headers := downloads[id].Headers
+	downloadsMu.Unlock()
+
+	req, err := http.NewRequest(http.MethodGet, fileURL, nil)
+	if err != nil {
+		updateStatus(id, "failed")
+		return
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		updateStatus(id, "failed")
 		return
 	}
 	defer resp.Body.Close()
 
-	filename := getFilename(resp, fileURL)
-	categoryDir := getCategoryDir(filename, resp.Header.Get("Content-Type"))
-	tempPath := filepath.Join(downloadDir, "temp", filename+".goloadtemp")
+	filename := filenameOverride
+	if filename == "" {
+		filename = getFilename(resp, fileURL)
+	}
+	categoryDir := categoryOverride
+	if categoryDir == "" {
+		categoryDir = getCategoryDir(filename, resp.Header.Get("Content-Type"))
+	}
+	// Scoped by download ID, not filename: two concurrent single-stream
+	// downloads that land on the same filename (e.g. feed items enqueued
+	// before either has finished) must not share a temp file.
+	tempPath := filepath.Join(downloadDir, "temp", id+".goloadtemp")
 	finalPath := filepath.Join(categoryDir, filename)
 
 	outFile, err := os.Create(tempPath)
@@ -114,7 +222,9 @@ func startDownload(id, fileURL string) {
 	downloadsMu.Unlock()
 
 	var sizeCurrent int64
-	writer := io.MultiWriter(outFile, bar)
+	sha256Hasher := sha256.New()
+	md5Hasher := md5.New()
+	writer := io.MultiWriter(outFile, bar, sha256Hasher, md5Hasher)
 	buf := make([]byte, 32*1024)
 	startTime := time.Now()
 
@@ -139,7 +249,10 @@ func startDownload(id, fileURL string) {
 			downloadsMu.Lock()
 			downloads[id].SizeCurrent = sizeCurrent
 			downloads[id].Progress = progress
+			dl := downloads[id]
 			downloadsMu.Unlock()
+			persistDownload(dl, false)
+			emitUpdate(id, false)
 		}
 		if err == io.EOF {
 			break
@@ -150,8 +263,24 @@ func startDownload(id, fileURL string) {
 		}
 	}
 
+	shaHex := hex.EncodeToString(sha256Hasher.Sum(nil))
+	md5Hex := hex.EncodeToString(md5Hasher.Sum(nil))
+
+	downloadsMu.Lock()
+	expectedSHA256 := downloads[id].ExpectedSHA256
+	expectedSize := downloads[id].ExpectedSize
+	downloadsMu.Unlock()
+	expected := extractExpectedDigest(resp.Header)
+
+	if checksumMismatch(shaHex, md5Hex, sizeCurrent, expected, expectedSHA256, expectedSize) {
+		corruptPath := finalPath + ".corrupt"
+		os.Rename(tempPath, corruptPath)
+		finishDownload(id, "corrupt", corruptPath, shaHex)
+		return
+	}
+
 	os.Rename(tempPath, finalPath)
-	updateStatus(id, "completed")
+	finishDownload(id, "completed", finalPath, shaHex)
 }
 
 func getFilename(resp *http.Response, fileURL string) string {
@@ -185,10 +314,15 @@ func getCategoryDir(filename, mimeType string) string {
 
 func updateStatus(id, status string) {
 	downloadsMu.Lock()
-	defer downloadsMu.Unlock()
-	if dl, exists := downloads[id]; exists {
+	dl, exists := downloads[id]
+	if exists {
 		dl.Status = status
 	}
+	downloadsMu.Unlock()
+	if exists {
+		persistDownload(dl, true)
+	}
+	emitUpdate(id, true)
 }
 
 func getDownloads(c *gin.Context) {
@@ -211,6 +345,9 @@ func clearFailed(c *gin.Context) {
 	for id, dl := range downloads {
 		if dl.Status == "failed" {
 			delete(downloads, id)
+			if store != nil {
+				store.Delete(id)
+			}
 		}
 	}
 
@@ -223,6 +360,15 @@ func main() {
 	r.POST("/add", addDownload)
 	r.GET("/downloads", getDownloads)
 	r.DELETE("/clear_failed", clearFailed)
+	r.POST("/pause/:id", pauseDownload)
+	r.POST("/resume/:id", resumeDownload)
+	r.POST("/feeds", addFeed)
+	r.GET("/feeds", getFeeds)
+	r.DELETE("/feeds/:id", deleteFeed)
+	r.GET("/ws", serveWS)
+	r.POST("/archive", createArchive)
+	r.GET("/file/:id", getFile)
+	r.GET("/browse/*path", browseDir)
 
 	log.Printf("GoLoad server running on http://localhost:%d ðŸš€ \n", PORT)
 	r.Run(fmt.Sprintf(":%d", PORT))
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+var (
+	downloadsBucket = []byte("downloads")
+	feedsBucket     = []byte("feeds")
+)
+
+// Store persists Download records across restarts. The in-memory
+// `downloads` map stays the hot path for reads and per-byte progress
+// updates; Store is the thin write-through/rehydration layer behind it.
+//
+// It also persists feed subscriptions (the `feeds` bucket) for the same
+// reason: the in-memory `feeds` map is the hot path, Store just survives
+// a restart.
+type Store interface {
+	Get(id string) (*Download, bool)
+	Put(dl *Download) error
+	Delete(id string) error
+	List() ([]*Download, error)
+
+	PutFeed(f *Feed) error
+	DeleteFeed(id string) error
+	ListFeeds() ([]*Feed, error)
+
+	Close() error
+}
+
+// boltStore is the default Store, backed by a single bbolt database file
+// living alongside the rest of GoLoad's state.
+type boltStore struct {
+	db *bbolt.DB
+}
+
+func openStore(path string) (Store, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(downloadsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(feedsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Get(id string) (*Download, bool) {
+	var dl Download
+	found := false
+	s.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(downloadsBucket).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		if err := json.Unmarshal(data, &dl); err != nil {
+			return err
+		}
+		found = true
+		return nil
+	})
+	if !found {
+		return nil, false
+	}
+	return &dl, true
+}
+
+func (s *boltStore) Put(dl *Download) error {
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(downloadsBucket).Put([]byte(dl.ID), data)
+	})
+}
+
+func (s *boltStore) Delete(id string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(downloadsBucket).Delete([]byte(id))
+	})
+}
+
+func (s *boltStore) List() ([]*Download, error) {
+	var list []*Download
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(downloadsBucket).ForEach(func(_, data []byte) error {
+			var dl Download
+			if err := json.Unmarshal(data, &dl); err != nil {
+				return err
+			}
+			list = append(list, &dl)
+			return nil
+		})
+	})
+	return list, err
+}
+
+func (s *boltStore) PutFeed(f *Feed) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(feedsBucket).Put([]byte(f.ID), data)
+	})
+}
+
+func (s *boltStore) DeleteFeed(id string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(feedsBucket).Delete([]byte(id))
+	})
+}
+
+func (s *boltStore) ListFeeds() ([]*Feed, error) {
+	var list []*Feed
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(feedsBucket).ForEach(func(_, data []byte) error {
+			var f Feed
+			if err := json.Unmarshal(data, &f); err != nil {
+				return err
+			}
+			list = append(list, &f)
+			return nil
+		})
+	})
+	return list, err
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+var (
+	persistedAt   = make(map[string]time.Time)
+	persistedAtMu sync.Mutex
+)
+
+// persistDownloadTickInterval throttles write-through of per-byte progress
+// updates to roughly once a second; status transitions always persist
+// immediately regardless of this interval.
+const persistDownloadTickInterval = time.Second
+
+// persistDownload writes dl through to the Store. Progress-tick callers
+// should pass force=false so rapid updates are throttled; status
+// transitions and terminal states must pass force=true.
+func persistDownload(dl *Download, force bool) {
+	if store == nil {
+		return
+	}
+
+	persistedAtMu.Lock()
+	last, ok := persistedAt[dl.ID]
+	if !force && ok && time.Since(last) < persistDownloadTickInterval {
+		persistedAtMu.Unlock()
+		return
+	}
+	persistedAt[dl.ID] = time.Now()
+	persistedAtMu.Unlock()
+
+	downloadsMu.Lock()
+	snapshot := *dl
+	downloadsMu.Unlock()
+
+	if err := store.Put(&snapshot); err != nil {
+		log.Println("Error persisting download:", dl.ID, err)
+	}
+}
+
+// loadDownloads rehydrates the in-memory map from the Store on startup.
+// Anything still "in_progress" lost its goroutine when the process died.
+// If it has a sidecar, it's a segmented download and can be surfaced as
+// "paused" for the user to resume via POST /resume/:id; otherwise it was a
+// single-stream download with no resumable state, so it's surfaced as
+// "failed" so /clear_failed can clean it up instead of leaving a dead entry.
+func loadDownloads() {
+	records, err := store.List()
+	if err != nil {
+		log.Println("Error loading persisted downloads:", err)
+		return
+	}
+
+	downloadsMu.Lock()
+	defer downloadsMu.Unlock()
+	for _, dl := range records {
+		if dl.Status == "in_progress" {
+			if _, err := loadSidecar(dl.ID); err == nil {
+				dl.Status = "paused"
+			} else {
+				dl.Status = "failed"
+			}
+		}
+		downloads[dl.ID] = dl
+	}
+}
+
+func storePath() string {
+	return filepath.Join(downloadDir, "goload.db")
+}
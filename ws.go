@@ -0,0 +1,142 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// progressTickInterval throttles how often a single download's progress is
+// pushed to WS clients, so a fast local transfer doesn't flood the hub with
+// a message per 32 KiB chunk.
+const progressTickInterval = 200 * time.Millisecond
+
+// DownloadUpdate is the JSON delta pushed to WS subscribers whenever a
+// Download's state, progress, or speed changes.
+type DownloadUpdate struct {
+	ID          string  `json:"id"`
+	Status      string  `json:"status"`
+	SizeCurrent int64   `json:"size_current"`
+	Progress    float64 `json:"progress"`
+	Speed       int64   `json:"speed"`
+}
+
+var (
+	events = make(chan DownloadUpdate, 256)
+
+	wsUpgrader = websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+
+	wsClients   = make(map[*websocket.Conn]chan DownloadUpdate)
+	wsClientsMu sync.Mutex
+
+	lastEmitted   = make(map[string]time.Time)
+	lastEmittedMu sync.Mutex
+)
+
+func init() {
+	go runHub()
+}
+
+// runHub multiplexes every DownloadUpdate onto all subscribed WS clients.
+func runHub() {
+	for update := range events {
+		wsClientsMu.Lock()
+		for _, ch := range wsClients {
+			select {
+			case ch <- update:
+			default:
+				// Slow client: drop this tick rather than block the hub.
+			}
+		}
+		wsClientsMu.Unlock()
+	}
+}
+
+// emitUpdate snapshots a download's current state and pushes it to the
+// hub, throttled to progressTickInterval unless force is set (used for
+// status transitions, which bypass the throttle). The send never blocks:
+// any update, forced or not, is dropped if the events buffer is full.
+func emitUpdate(id string, force bool) {
+	downloadsMu.Lock()
+	dl, exists := downloads[id]
+	var snapshot DownloadUpdate
+	if exists {
+		snapshot = DownloadUpdate{
+			ID:          dl.ID,
+			Status:      dl.Status,
+			SizeCurrent: dl.SizeCurrent,
+			Progress:    dl.Progress,
+			Speed:       dl.Speed,
+		}
+	}
+	downloadsMu.Unlock()
+	if !exists {
+		return
+	}
+
+	if !force {
+		lastEmittedMu.Lock()
+		last, ok := lastEmitted[id]
+		if ok && time.Since(last) < progressTickInterval {
+			lastEmittedMu.Unlock()
+			return
+		}
+		lastEmitted[id] = time.Now()
+		lastEmittedMu.Unlock()
+	}
+
+	select {
+	case events <- snapshot:
+	default:
+	}
+}
+
+// serveWS upgrades the connection and streams DownloadUpdate deltas to the
+// client until it disconnects. Clients should GET /downloads first for an
+// initial snapshot.
+func serveWS(c *gin.Context) {
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Println("WS upgrade failed:", err)
+		return
+	}
+	defer conn.Close()
+
+	ch := make(chan DownloadUpdate, 64)
+	wsClientsMu.Lock()
+	wsClients[conn] = ch
+	wsClientsMu.Unlock()
+	defer func() {
+		wsClientsMu.Lock()
+		delete(wsClients, conn)
+		wsClientsMu.Unlock()
+	}()
+
+	// Detect client disconnects so we stop writing to a dead connection.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case update := <-ch:
+			if err := conn.WriteJSON(update); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}